@@ -0,0 +1,396 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package buckettree
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// bucketCacheMetrics tracks hit/miss/prefetch-drop counters for the bucket
+// and data node caches. All fields are accessed via sync/atomic since both
+// the prefetch workers and the main ComputeCryptoHash path read/write them.
+type bucketCacheMetrics struct {
+	hits            int64
+	misses          int64
+	prefetchDropped int64
+}
+
+func (m *bucketCacheMetrics) recordHit()  { atomic.AddInt64(&m.hits, 1) }
+func (m *bucketCacheMetrics) recordMiss() { atomic.AddInt64(&m.misses, 1) }
+func (m *bucketCacheMetrics) recordPrefetchDropped() {
+	atomic.AddInt64(&m.prefetchDropped, 1)
+}
+
+// Hits returns the number of cache hits observed so far.
+func (m *bucketCacheMetrics) Hits() int64 { return atomic.LoadInt64(&m.hits) }
+
+// Misses returns the number of cache misses observed so far.
+func (m *bucketCacheMetrics) Misses() int64 { return atomic.LoadInt64(&m.misses) }
+
+// PrefetchDropped returns the number of prefetch jobs dropped - either
+// because the prefetch worker pool's job queue was full, or because a commit
+// landed while the job's own uncached DB read was in flight (see
+// cacheGeneration).
+func (m *bucketCacheMetrics) PrefetchDropped() int64 {
+	return atomic.LoadInt64(&m.prefetchDropped)
+}
+
+var bucketCacheStats = &bucketCacheMetrics{}
+var dataNodeCacheStats = &bucketCacheMetrics{}
+
+// lruEntry is the value stored in an lruCache's backing list.
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+// lruCache is a bounded, mutex-protected least-recently-used cache keyed by
+// the encoded form of a bucketKey/dataKey. A size of 0 disables the cache
+// (Get always misses, Put is a no-op) so that callers do not need to special
+// case an unconfigured cache.
+type lruCache struct {
+	lock     sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *lruCache) get(key string) (interface{}, bool) {
+	if c.capacity <= 0 {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return elem.Value.(*lruEntry).value, true
+}
+
+func (c *lruCache) put(key string, value interface{}) {
+	if c.capacity <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.ll.MoveToFront(elem)
+		elem.Value.(*lruEntry).value = value
+		return
+	}
+	elem := c.ll.PushFront(&lruEntry{key, value})
+	c.items[key] = elem
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*lruEntry).key)
+		}
+	}
+}
+
+func (c *lruCache) remove(key string) {
+	if c.capacity <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.ll.Remove(elem)
+		delete(c.items, key)
+	}
+}
+
+// bucketNodeCache is a tiered cache for bucketNodes: levels 0 (the root)
+// through pinnedLevels of the bucket tree (closest to the root, and therefore
+// touched by almost every ComputeCryptoHash call) are pinned in memory in
+// full, while the remaining lower levels are served from a bounded LRU.
+type bucketNodeCache struct {
+	pinnedLevels int
+	pinned       sync.Map // encoded bucketKey -> *bucketNode
+	lru          *lruCache
+}
+
+func newBucketNodeCache(pinnedLevels int, lruSize int) *bucketNodeCache {
+	return &bucketNodeCache{
+		pinnedLevels: pinnedLevels,
+		lru:          newLRUCache(lruSize),
+	}
+}
+
+func (c *bucketNodeCache) get(key *bucketKey) *bucketNode {
+	encodedKey := string(key.getEncodedBytes())
+	if key.level <= c.pinnedLevels {
+		if value, ok := c.pinned.Load(encodedKey); ok {
+			bucketCacheStats.recordHit()
+			return value.(*bucketNode)
+		}
+		bucketCacheStats.recordMiss()
+		return nil
+	}
+	if value, ok := c.lru.get(encodedKey); ok {
+		bucketCacheStats.recordHit()
+		return value.(*bucketNode)
+	}
+	bucketCacheStats.recordMiss()
+	return nil
+}
+
+func (c *bucketNodeCache) put(node *bucketNode) {
+	encodedKey := string(node.bucketKey.getEncodedBytes())
+	if node.bucketKey.level <= c.pinnedLevels {
+		c.pinned.Store(encodedKey, node)
+		return
+	}
+	c.lru.put(encodedKey, node)
+}
+
+func (c *bucketNodeCache) invalidate(key *bucketKey) {
+	encodedKey := string(key.getEncodedBytes())
+	if key.level <= c.pinnedLevels {
+		c.pinned.Delete(encodedKey)
+		return
+	}
+	c.lru.remove(encodedKey)
+}
+
+// dataNodeCache is a bounded LRU of dataNodes, populated by prefetch jobs
+// submitted via PerfHintKeyChanged.
+type dataNodeCache struct {
+	lru *lruCache
+}
+
+func newDataNodeCache(size int) *dataNodeCache {
+	return &dataNodeCache{lru: newLRUCache(size)}
+}
+
+func (c *dataNodeCache) get(bucketKey *bucketKey) (dataNodes, bool) {
+	value, ok := c.lru.get(string(bucketKey.getEncodedBytes()))
+	if !ok {
+		dataNodeCacheStats.recordMiss()
+		return nil, false
+	}
+	dataNodeCacheStats.recordHit()
+	return value.(dataNodes), true
+}
+
+func (c *dataNodeCache) put(bucketKey *bucketKey, nodes dataNodes) {
+	c.lru.put(string(bucketKey.getEncodedBytes()), nodes)
+}
+
+func (c *dataNodeCache) invalidate(bucketKey *bucketKey) {
+	c.lru.remove(string(bucketKey.getEncodedBytes()))
+}
+
+// prefetchJob describes a single (chaincodeID, key) hint to warm the caches for.
+type prefetchJob struct {
+	chaincodeID string
+	key         string
+}
+
+// prefetcher owns the worker pool that services PerfHintKeyChanged hints. Jobs
+// are dropped (and counted via bucketCacheStats.recordPrefetchDropped) rather
+// than blocking the caller, since a missed prefetch hint only costs a cache
+// miss later on, never correctness.
+type prefetcher struct {
+	jobs chan prefetchJob
+}
+
+func newPrefetcher(numWorkers int, queueSize int) *prefetcher {
+	p := &prefetcher{jobs: make(chan prefetchJob, queueSize)}
+	for i := 0; i < numWorkers; i++ {
+		go p.runWorker()
+	}
+	return p
+}
+
+func (p *prefetcher) submit(chaincodeID string, key string) {
+	select {
+	case p.jobs <- prefetchJob{chaincodeID, key}:
+	default:
+		bucketCacheStats.recordPrefetchDropped()
+	}
+}
+
+func (p *prefetcher) runWorker() {
+	for job := range p.jobs {
+		dataKey := newDataKey(job.chaincodeID, job.key)
+		bucketKey := dataKey.getBucketKey()
+		generation := loadCacheGeneration()
+		nodes, err := fetchDataNodesFromDBFor(bucketKey)
+		if err != nil {
+			logger.Debug("Prefetch for chaincodeID=[%s], key=[%s] failed: %s", job.chaincodeID, job.key, err)
+			continue
+		}
+		if loadCacheGeneration() != generation {
+			// A commit landed while this prefetch's own uncached read was in
+			// flight, so nodes may already be stale relative to what that
+			// commit just wrote into the cache - drop it rather than risk
+			// clobbering fresher content.
+			bucketCacheStats.recordPrefetchDropped()
+			continue
+		}
+		globalDataNodeCache.put(bucketKey, nodes)
+		warmAncestorBucketNodes(bucketKey, generation)
+	}
+}
+
+// warmAncestorBucketNodes populates the bucket-node cache for every ancestor
+// of bucketKey, up to the root, fetching from RocksDB on a miss. This is best
+// effort - any error, or any commit landing while it fetches (detected via
+// generation no longer matching the cacheGeneration snapshot taken before
+// this prefetch job's own DB read), simply aborts the walk up for this
+// prefetch job rather than risk clobbering a newer commit's cache entry.
+func warmAncestorBucketNodes(key *bucketKey, generation int64) {
+	for current := key.getParentKey(); current != nil; current = current.getParentKey() {
+		if globalBucketNodeCache.get(current) != nil {
+			continue
+		}
+		node, err := fetchBucketNodeFromDB(current)
+		if err != nil || node == nil {
+			return
+		}
+		if loadCacheGeneration() != generation {
+			bucketCacheStats.recordPrefetchDropped()
+			return
+		}
+		globalBucketNodeCache.put(node)
+	}
+}
+
+// globalBucketNodeCache and globalDataNodeCache back every StateImpl in this
+// process - the underlying RocksDB column families are process-wide, so a
+// single shared cache (sized via config) is simpler and more effective than
+// one cache per StateImpl instance.
+var globalBucketNodeCache *bucketNodeCache
+var globalDataNodeCache *dataNodeCache
+var globalPrefetcher *prefetcher
+var cacheInitOnce sync.Once
+
+// cacheGeneration is bumped once per commit, by ClearWorkingSet, right before
+// it repopulates globalBucketNodeCache/globalDataNodeCache with that
+// commit's content. A prefetch job snapshots it before its own uncached DB
+// read and skips writing into the cache if the generation has since moved -
+// otherwise a prefetch started just ahead of a commit could finish after it
+// and overwrite that commit's fresher cache entry with the stale, pre-commit
+// content it read.
+var cacheGeneration int64
+
+func bumpCacheGeneration() int64 { return atomic.AddInt64(&cacheGeneration, 1) }
+
+func loadCacheGeneration() int64 { return atomic.LoadInt64(&cacheGeneration) }
+
+func initCaches() {
+	cacheInitOnce.Do(func() {
+		globalBucketNodeCache = newBucketNodeCache(conf.getBucketCachePinnedLevels(), conf.getBucketCacheLRUSize())
+		globalDataNodeCache = newDataNodeCache(conf.getDataNodeCacheSize())
+		globalPrefetcher = newPrefetcher(conf.getPrefetchWorkerCount(), conf.getPrefetchQueueSize())
+	})
+}
+
+// cachedFetchBucketNodeFromDB is a drop-in replacement for
+// fetchBucketNodeFromDB that consults globalBucketNodeCache first and, on a
+// miss, stateImpl.diffLayers before falling through to RocksDB. The diff
+// layer chain - not just the bounded cache - must be consulted, since an
+// unflushed commit's bucket content can be evicted from the cache by
+// unrelated buckets long before the background diffLayerFlusher has written
+// it to RocksDB.
+func (stateImpl *StateImpl) cachedFetchBucketNodeFromDB(key *bucketKey) (*bucketNode, error) {
+	if node := globalBucketNodeCache.get(key); node != nil {
+		return node, nil
+	}
+	if stateImpl.diffLayers != nil {
+		if node, ok := stateImpl.diffLayers.getBucketNodeFor(key); ok {
+			globalBucketNodeCache.put(node)
+			return node, nil
+		}
+	}
+	node, err := fetchBucketNodeFromDB(key)
+	if err != nil {
+		return nil, err
+	}
+	if node != nil {
+		globalBucketNodeCache.put(node)
+	}
+	return node, nil
+}
+
+// cachedFetchDataNodesFromDBFor is a drop-in replacement for
+// fetchDataNodesFromDBFor that consults globalDataNodeCache first and, on a
+// miss, merges in stateImpl.diffLayers' unflushed content before falling
+// through to RocksDB - the data-node analogue of cachedFetchBucketNodeFromDB,
+// needed for the same reason.
+func (stateImpl *StateImpl) cachedFetchDataNodesFromDBFor(bucketKey *bucketKey) (dataNodes, error) {
+	if nodes, ok := globalDataNodeCache.get(bucketKey); ok {
+		return nodes, nil
+	}
+	persistedNodes, err := fetchDataNodesFromDBFor(bucketKey)
+	if err != nil {
+		return nil, err
+	}
+	nodes := persistedNodes
+	if stateImpl.diffLayers != nil {
+		nodes = mergeDataNodes(stateImpl.diffLayers.getDataNodesFor(bucketKey), persistedNodes)
+	}
+	globalDataNodeCache.put(bucketKey, nodes)
+	return nodes, nil
+}
+
+// getBucketCachePinnedLevels returns the deepest bucket-tree level kept fully
+// pinned in memory: levels 0 (the root) through this value are pinned, so the
+// default of 2 pins three levels.
+func (c *config) getBucketCachePinnedLevels() int {
+	return c.getInt("bucketCachePinnedLevels", 2)
+}
+
+// getBucketCacheLRUSize returns the capacity of the bounded LRU serving the
+// non-pinned bucket-tree levels.
+func (c *config) getBucketCacheLRUSize() int {
+	return c.getInt("bucketCacheLRUSize", 10000)
+}
+
+// getDataNodeCacheSize returns the capacity of the data-node LRU.
+func (c *config) getDataNodeCacheSize() int {
+	return c.getInt("dataNodeCacheSize", 10000)
+}
+
+// getPrefetchWorkerCount returns the number of background workers servicing
+// PerfHintKeyChanged hints.
+func (c *config) getPrefetchWorkerCount() int {
+	return c.getInt("prefetchWorkerCount", 2)
+}
+
+// getPrefetchQueueSize returns the capacity of the prefetch worker pool's job
+// queue; hints submitted while the queue is full are dropped.
+func (c *config) getPrefetchQueueSize() int {
+	return c.getInt("prefetchQueueSize", 1000)
+}
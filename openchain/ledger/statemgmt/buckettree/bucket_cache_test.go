@@ -0,0 +1,170 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package buckettree
+
+import (
+	"testing"
+)
+
+// TestLRUCache_EvictsLeastRecentlyUsed verifies that once a lruCache is at
+// capacity, inserting one more entry evicts the least recently touched one,
+// not simply the oldest-inserted one - accessing an entry via get must count
+// as a touch that protects it from the next eviction.
+func TestLRUCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newLRUCache(2)
+	cache.put("a", "valueA")
+	cache.put("b", "valueB")
+
+	if _, ok := cache.get("a"); !ok {
+		t.Fatalf("expected key 'a' to still be cached")
+	}
+	// "a" was just touched, so "b" is now the least recently used entry.
+	cache.put("c", "valueC")
+
+	if _, ok := cache.get("b"); ok {
+		t.Fatalf("expected key 'b' to have been evicted in favor of the more recently used 'a'")
+	}
+	if value, ok := cache.get("a"); !ok || value != "valueA" {
+		t.Fatalf("expected key 'a' to survive eviction, got value=%v ok=%v", value, ok)
+	}
+	if value, ok := cache.get("c"); !ok || value != "valueC" {
+		t.Fatalf("expected newly inserted key 'c' to be cached, got value=%v ok=%v", value, ok)
+	}
+}
+
+// TestLRUCache_PutOverwritesAndTouches verifies that re-putting an existing
+// key updates its value in place and counts as a touch, without growing the
+// cache past capacity or evicting anything.
+func TestLRUCache_PutOverwritesAndTouches(t *testing.T) {
+	cache := newLRUCache(2)
+	cache.put("a", "valueA")
+	cache.put("b", "valueB")
+	cache.put("a", "valueA2")
+	// "a" was just re-put, so "b" is now the least recently used entry.
+	cache.put("c", "valueC")
+
+	if value, ok := cache.get("a"); !ok || value != "valueA2" {
+		t.Fatalf("expected key 'a' to hold the overwritten value, got value=%v ok=%v", value, ok)
+	}
+	if _, ok := cache.get("b"); ok {
+		t.Fatalf("expected key 'b' to have been evicted")
+	}
+}
+
+// TestLRUCache_ZeroCapacityDisablesCache verifies the documented behavior
+// that a size-0 lruCache always misses on get and silently drops every put,
+// so callers with caching disabled via config don't need to special-case it.
+func TestLRUCache_ZeroCapacityDisablesCache(t *testing.T) {
+	cache := newLRUCache(0)
+	cache.put("a", "valueA")
+	if _, ok := cache.get("a"); ok {
+		t.Fatalf("expected a zero-capacity cache to never return a hit")
+	}
+}
+
+// TestLRUCache_Remove verifies that remove evicts a key immediately, and is
+// a no-op for a key that was never present.
+func TestLRUCache_Remove(t *testing.T) {
+	cache := newLRUCache(2)
+	cache.put("a", "valueA")
+	cache.remove("a")
+	if _, ok := cache.get("a"); ok {
+		t.Fatalf("expected key 'a' to have been removed")
+	}
+	cache.remove("never-present")
+}
+
+// TestBucketNodeCache_PinnedLevelsBypassLRU verifies that a bucketNodeCache
+// serves levels at or below pinnedLevels from the unbounded pinned map
+// (never evicted) while deeper levels go through the bounded LRU and can be
+// evicted once it is full.
+func TestBucketNodeCache_PinnedLevelsBypassLRU(t *testing.T) {
+	cache := newBucketNodeCache(1, 1)
+
+	pinned := &bucketNode{bucketKey: &bucketKey{level: 1, bucketNumber: 1}}
+	cache.put(pinned)
+
+	lruA := &bucketNode{bucketKey: &bucketKey{level: 2, bucketNumber: 1}}
+	lruB := &bucketNode{bucketKey: &bucketKey{level: 2, bucketNumber: 2}}
+	cache.put(lruA)
+	cache.put(lruB)
+
+	if cache.get(pinned.bucketKey) == nil {
+		t.Fatalf("expected a pinned-level node to never be evicted regardless of LRU pressure")
+	}
+	if cache.get(lruA.bucketKey) != nil {
+		t.Fatalf("expected the first LRU-level node to be evicted once the size-1 LRU took a second entry")
+	}
+	if cache.get(lruB.bucketKey) == nil {
+		t.Fatalf("expected the most recently put LRU-level node to still be cached")
+	}
+}
+
+// TestBucketCacheMetrics_RecordsHitsAndMisses verifies that
+// bucketNodeCache.get increments the shared bucketCacheStats hit/miss
+// counters, for both the pinned and LRU tiers.
+func TestBucketCacheMetrics_RecordsHitsAndMisses(t *testing.T) {
+	stats := &bucketCacheMetrics{}
+	cache := newBucketNodeCache(1, 10)
+	withStats(t, &bucketCacheStats, stats, func() {
+		pinned := &bucketNode{bucketKey: &bucketKey{level: 1, bucketNumber: 1}}
+		cache.put(pinned)
+		cache.get(pinned.bucketKey)
+		cache.get(&bucketKey{level: 1, bucketNumber: 2})
+
+		lruNode := &bucketNode{bucketKey: &bucketKey{level: 2, bucketNumber: 1}}
+		cache.put(lruNode)
+		cache.get(lruNode.bucketKey)
+		cache.get(&bucketKey{level: 2, bucketNumber: 2})
+	})
+
+	if stats.Hits() != 2 {
+		t.Fatalf("expected 2 hits (one pinned, one LRU), got %d", stats.Hits())
+	}
+	if stats.Misses() != 2 {
+		t.Fatalf("expected 2 misses (one pinned, one LRU), got %d", stats.Misses())
+	}
+}
+
+// TestBucketCacheMetrics_RecordsPrefetchDropped verifies that submitting a
+// prefetch job to a prefetcher whose queue is already full increments
+// PrefetchDropped rather than blocking the caller.
+func TestBucketCacheMetrics_RecordsPrefetchDropped(t *testing.T) {
+	stats := &bucketCacheMetrics{}
+	withStats(t, &bucketCacheStats, stats, func() {
+		p := &prefetcher{jobs: make(chan prefetchJob, 1)}
+		p.submit("chaincodeA", "key1")
+		p.submit("chaincodeA", "key2")
+	})
+
+	if dropped := stats.PrefetchDropped(); dropped != 1 {
+		t.Fatalf("expected the second submit to a full queue to be dropped exactly once, got %d", dropped)
+	}
+}
+
+// withStats swaps *target for replacement for the duration of fn, restoring
+// the original afterward, so metrics tests can assert on a clean counter
+// without interfering with the shared package-level bucketCacheStats.
+func withStats(t *testing.T, target **bucketCacheMetrics, replacement *bucketCacheMetrics, fn func()) {
+	original := *target
+	*target = replacement
+	defer func() { *target = original }()
+	fn()
+}
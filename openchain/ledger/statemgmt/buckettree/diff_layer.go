@@ -0,0 +1,268 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package buckettree
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/tecbot/gorocksdb"
+	"github.com/openblockchain/obc-peer/openchain/db"
+)
+
+// shutdownFlushRetryInterval is how long flushAll waits before retrying a
+// failed write when draining the chain at shutdown; unlike the periodic
+// ticker-driven flushOne calls, shutdown must not give up and silently drop
+// layers that were already handed off via ClearWorkingSet(true).
+const shutdownFlushRetryInterval = 500 * time.Millisecond
+
+// stateDiffLayer is an immutable, committed-but-not-yet-flushed delta: the
+// result of one block's PrepareWorkingSet/ComputeCryptoHash, captured by
+// ClearWorkingSet(true) instead of being written to RocksDB on the spot. Once constructed, a layer is never mutated, so it is safe to read
+// from multiple goroutines without locking.
+type stateDiffLayer struct {
+	dataNodesDelta  *dataNodesDelta
+	bucketTreeDelta *bucketTreeDelta
+	rootHash        []byte
+}
+
+// getDataNode looks up a single key within this layer only.
+func (layer *stateDiffLayer) getDataNode(key *dataKey) (*dataNode, bool) {
+	for _, node := range layer.dataNodesDelta.getSortedDataNodesFor(key.getBucketKey()) {
+		if bytes.Equal(node.dataKey.compositeKey, key.compositeKey) {
+			return node, true
+		}
+	}
+	return nil, false
+}
+
+// getBucketNode looks up a single bucket node within this layer only.
+func (layer *stateDiffLayer) getBucketNode(bucketKey *bucketKey) (*bucketNode, bool) {
+	for _, node := range layer.bucketTreeDelta.getBucketNodesAt(bucketKey.level) {
+		if node.bucketKey.equals(bucketKey) {
+			return node, true
+		}
+	}
+	return nil, false
+}
+
+// diffLayerChain is an ordered chain of stateDiffLayers, oldest first. Reads
+// consult it newest-to-oldest before falling back to RocksDB. A background
+// flusher drains from the oldest end and flattens layers into RocksDB write
+// batches; pushLayer applies back-pressure once maxLayers is reached so that
+// memory use stays bounded if flushing falls behind.
+type diffLayerChain struct {
+	mu        sync.Mutex
+	notFull   *sync.Cond
+	layers    []*stateDiffLayer
+	maxLayers int
+}
+
+func newDiffLayerChain(maxLayers int) *diffLayerChain {
+	chain := &diffLayerChain{maxLayers: maxLayers}
+	chain.notFull = sync.NewCond(&chain.mu)
+	return chain
+}
+
+// pushLayer appends a newly-committed layer, blocking while the chain is at
+// capacity (i.e., the background flusher has fallen behind).
+func (chain *diffLayerChain) pushLayer(layer *stateDiffLayer) {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+	for chain.maxLayers > 0 && len(chain.layers) >= chain.maxLayers {
+		chain.notFull.Wait()
+	}
+	chain.layers = append(chain.layers, layer)
+}
+
+// oldestLayer returns the oldest unflushed layer, if any, without removing it.
+func (chain *diffLayerChain) oldestLayer() *stateDiffLayer {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+	if len(chain.layers) == 0 {
+		return nil
+	}
+	return chain.layers[0]
+}
+
+// dropOldest removes the oldest layer once the flusher has durably written
+// it, and wakes up any goroutine blocked in pushLayer.
+func (chain *diffLayerChain) dropOldest() {
+	chain.mu.Lock()
+	if len(chain.layers) > 0 {
+		chain.layers = chain.layers[1:]
+	}
+	chain.mu.Unlock()
+	chain.notFull.Broadcast()
+}
+
+// snapshotTip returns the chain's layers as they stand right now, newest
+// last. Combined with a pinned gorocksdb.Snapshot taken at the same instant,
+// this gives GetStateSnapshotIterator a consistent point-in-time view even
+// though the chain keeps growing/draining concurrently.
+func (chain *diffLayerChain) snapshotTip() []*stateDiffLayer {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+	tip := make([]*stateDiffLayer, len(chain.layers))
+	copy(tip, chain.layers)
+	return tip
+}
+
+// getDataNode searches the chain newest-to-oldest for key, returning
+// (node, true) on a hit so that a tombstone (deleted node) shadows any
+// earlier value rather than falling through to RocksDB.
+func (chain *diffLayerChain) getDataNode(key *dataKey) (*dataNode, bool) {
+	chain.mu.Lock()
+	layers := make([]*stateDiffLayer, len(chain.layers))
+	copy(layers, chain.layers)
+	chain.mu.Unlock()
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		if node, ok := layers[i].getDataNode(key); ok {
+			return node, true
+		}
+	}
+	return nil, false
+}
+
+// getDataNodesFor returns every node this chain holds for bucketKey, merged
+// newest-layer-wins across the chain (including tombstones) - the
+// bucket-scoped analogue of getDataNode, used by GetStateProof, which needs
+// a bucket's full sibling set rather than a single key.
+func (chain *diffLayerChain) getDataNodesFor(bucketKey *bucketKey) dataNodes {
+	return flattenDataNodesForBucket(chain.snapshotTip(), bucketKey)
+}
+
+// getBucketNodeFor searches the chain newest-to-oldest for bucketKey. Unlike
+// getDataNodesFor, no cross-layer merge is needed: mergeBucketNodeWithDB
+// already folds every predecessor (cache, chain, or RocksDB) into a bucket
+// node's child-hashes at the point it is committed into a layer, so the
+// newest layer that touched this bucket already holds its complete content.
+func (chain *diffLayerChain) getBucketNodeFor(bucketKey *bucketKey) (*bucketNode, bool) {
+	chain.mu.Lock()
+	layers := make([]*stateDiffLayer, len(chain.layers))
+	copy(layers, chain.layers)
+	chain.mu.Unlock()
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		if node, ok := layers[i].getBucketNode(bucketKey); ok {
+			return node, true
+		}
+	}
+	return nil, false
+}
+
+// diffLayerFlusher periodically writes the oldest layer of a diffLayerChain
+// to RocksDB, one layer per write batch, decoupling
+// ComputeCryptoHash (on the critical path of the current block) from the
+// actual disk write (which can proceed while the next block is processed).
+type diffLayerFlusher struct {
+	chain  *diffLayerChain
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+func startDiffLayerFlusher(chain *diffLayerChain, interval time.Duration) *diffLayerFlusher {
+	flusher := &diffLayerFlusher{
+		chain:  chain,
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	go flusher.run(interval)
+	return flusher
+}
+
+func (flusher *diffLayerFlusher) run(interval time.Duration) {
+	defer close(flusher.doneCh)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-flusher.stopCh:
+			flusher.flushAllOrRetry()
+			return
+		case <-ticker.C:
+			if _, err := flusher.flushOne(); err != nil {
+				logger.Error("Failed to flush state diff layer to RocksDB: %s", err)
+			}
+		}
+	}
+}
+
+// flushAllOrRetry drains every remaining layer before the flusher shuts
+// down. Unlike the periodic ticker path, a write failure here must not be
+// allowed to silently abandon a layer that ClearWorkingSet(true) already
+// handed off as committed - so it retries indefinitely, logging each
+// failed attempt, until the chain is empty.
+func (flusher *diffLayerFlusher) flushAllOrRetry() {
+	for {
+		flushed, err := flusher.flushOne()
+		if err != nil {
+			logger.Error("Failed to flush state diff layer to RocksDB during shutdown, retrying: %s", err)
+			time.Sleep(shutdownFlushRetryInterval)
+			continue
+		}
+		if !flushed {
+			return
+		}
+	}
+}
+
+// flushOne writes the oldest unflushed layer to RocksDB and drops it from the
+// chain. It returns (false, nil) when there was nothing to flush, and
+// (false, err) when the write itself failed - the two must stay
+// distinguishable so callers like flushAllOrRetry know to retry rather than
+// treat a write failure as an empty chain.
+func (flusher *diffLayerFlusher) flushOne() (bool, error) {
+	layer := flusher.chain.oldestLayer()
+	if layer == nil {
+		return false, nil
+	}
+	openchainDB := db.GetDBHandle()
+	writeBatch := gorocksdb.NewWriteBatch()
+	defer writeBatch.Destroy()
+	addDataNodeChangesForPersistence(writeBatch, layer.dataNodesDelta)
+	addBucketNodeChangesForPersistence(writeBatch, layer.bucketTreeDelta)
+	if err := openchainDB.DB.Write(gorocksdb.NewDefaultWriteOptions(), writeBatch); err != nil {
+		return false, err
+	}
+	flusher.chain.dropOldest()
+	return true, nil
+}
+
+func (flusher *diffLayerFlusher) stop() {
+	close(flusher.stopCh)
+	<-flusher.doneCh
+}
+
+// getMaxDiffLayers returns the maximum number of committed-but-unflushed
+// diff layers to keep pinned in memory before pushLayer starts blocking. A
+// value <= 0 disables the diff-layer chain entirely, reverting to
+// synchronous RocksDB writes from AddChangesForPersistence.
+func (c *config) getMaxDiffLayers() int {
+	return c.getInt("maxDiffLayers", 10)
+}
+
+// getDiffLayerFlushInterval returns how often the background
+// diffLayerFlusher wakes up to flush the oldest unflushed layer.
+func (c *config) getDiffLayerFlushInterval() time.Duration {
+	return c.getDuration("diffLayerFlushInterval", 2*time.Second)
+}
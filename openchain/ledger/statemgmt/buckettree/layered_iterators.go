@@ -0,0 +1,229 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package buckettree
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/openblockchain/obc-peer/openchain/ledger/statemgmt"
+)
+
+// flattenDataNodes merges a chain of diff layers (oldest first) into a
+// single, sorted, de-duplicated slice of dataNodes - the newest update to a
+// given key wins, including tombstones for deletes.
+func flattenDataNodes(layers []*stateDiffLayer) dataNodes {
+	latest := make(map[string]*dataNode)
+	order := make([]string, 0)
+	for _, layer := range layers {
+		for _, bucketKey := range layer.dataNodesDelta.getAffectedBuckets() {
+			for _, node := range layer.dataNodesDelta.getSortedDataNodesFor(bucketKey) {
+				compositeKey := string(node.dataKey.compositeKey)
+				if _, ok := latest[compositeKey]; !ok {
+					order = append(order, compositeKey)
+				}
+				latest[compositeKey] = node
+			}
+		}
+	}
+	sort.Strings(order)
+	merged := make(dataNodes, len(order))
+	for i, compositeKey := range order {
+		merged[i] = latest[compositeKey]
+	}
+	return merged
+}
+
+// flattenDataNodesForBucket is the single-bucket analogue of
+// flattenDataNodes: it merges a chain of diff layers (oldest first)
+// restricted to bucketKey into a single, sorted slice, the newest update to
+// a given key winning, including tombstones for deletes.
+func flattenDataNodesForBucket(layers []*stateDiffLayer, bucketKey *bucketKey) dataNodes {
+	latest := make(map[string]*dataNode)
+	order := make([]string, 0)
+	for _, layer := range layers {
+		for _, node := range layer.dataNodesDelta.getSortedDataNodesFor(bucketKey) {
+			compositeKey := string(node.dataKey.compositeKey)
+			if _, ok := latest[compositeKey]; !ok {
+				order = append(order, compositeKey)
+			}
+			latest[compositeKey] = node
+		}
+	}
+	sort.Strings(order)
+	merged := make(dataNodes, len(order))
+	for i, compositeKey := range order {
+		merged[i] = latest[compositeKey]
+	}
+	return merged
+}
+
+// layeredStateSnapshotIterator overlays the flattened, pinned diff-layer
+// entries on top of a RocksDB snapshot iterator so that a point-in-time
+// state snapshot includes blocks that have been committed (ComputeCryptoHash
+// run, ClearWorkingSet(true) called) but not yet flushed by the background
+// diffLayerFlusher.
+type layeredStateSnapshotIterator struct {
+	overlay    dataNodes
+	overlayPos int
+	dbIter     statemgmt.StateSnapshotIterator
+	dbExists   bool
+	current    *dataNode
+}
+
+func newLayeredStateSnapshotIterator(layers []*stateDiffLayer, dbIter statemgmt.StateSnapshotIterator) *layeredStateSnapshotIterator {
+	iter := &layeredStateSnapshotIterator{
+		overlay: flattenDataNodes(layers),
+		dbIter:  dbIter,
+	}
+	iter.dbExists = dbIter.Next()
+	return iter
+}
+
+// Next advances to the next key in sorted order across both the overlay and
+// the underlying DB iterator, skipping DB entries shadowed by the overlay
+// (including ones shadowed by a tombstone).
+func (iter *layeredStateSnapshotIterator) Next() bool {
+	for {
+		overlayHasMore := iter.overlayPos < len(iter.overlay)
+		if !overlayHasMore && !iter.dbExists {
+			iter.current = nil
+			return false
+		}
+
+		if overlayHasMore && iter.dbExists {
+			dbKey, _ := iter.dbIter.GetRawKeyValue()
+			overlayKey := iter.overlay[iter.overlayPos].dataKey.getEncodedBytes()
+			c := bytes.Compare(overlayKey, dbKey)
+			if c < 0 {
+				iter.current = iter.overlay[iter.overlayPos]
+				iter.overlayPos++
+			} else if c == 0 {
+				iter.current = iter.overlay[iter.overlayPos]
+				iter.overlayPos++
+				iter.dbExists = iter.dbIter.Next()
+			} else {
+				dbKey, dbValue := iter.dbIter.GetRawKeyValue()
+				iter.current = &dataNode{dataKey: &dataKey{compositeKey: dbKey}, value: dbValue}
+				iter.dbExists = iter.dbIter.Next()
+			}
+		} else if overlayHasMore {
+			iter.current = iter.overlay[iter.overlayPos]
+			iter.overlayPos++
+		} else {
+			dbKey, dbValue := iter.dbIter.GetRawKeyValue()
+			iter.current = &dataNode{dataKey: &dataKey{compositeKey: dbKey}, value: dbValue}
+			iter.dbExists = iter.dbIter.Next()
+		}
+
+		if iter.current.isDelete() {
+			continue
+		}
+		return true
+	}
+}
+
+// GetRawKeyValue returns the encoded key and raw value of the current entry.
+func (iter *layeredStateSnapshotIterator) GetRawKeyValue() ([]byte, []byte) {
+	return iter.current.dataKey.getEncodedBytes(), iter.current.value
+}
+
+// Close releases the underlying DB iterator.
+func (iter *layeredStateSnapshotIterator) Close() {
+	iter.dbIter.Close()
+}
+
+// layeredRangeScanIterator is the GetRangeScanIterator analogue of
+// layeredStateSnapshotIterator: it overlays the pinned diff-layer entries for
+// a single chaincodeID's [startKey, endKey] range on top of the RocksDB-backed
+// range scan iterator.
+type layeredRangeScanIterator struct {
+	overlay    dataNodes
+	overlayPos int
+	dbIter     statemgmt.RangeScanIterator
+	dbExists   bool
+	current    *dataNode
+}
+
+func newLayeredRangeScanIterator(layers []*stateDiffLayer, chaincodeID string, startKey string, endKey string, dbIter statemgmt.RangeScanIterator) *layeredRangeScanIterator {
+	all := flattenDataNodes(layers)
+	inRange := make(dataNodes, 0, len(all))
+	for _, node := range all {
+		if node.dataKey.chaincodeID != chaincodeID {
+			continue
+		}
+		if startKey != "" && node.dataKey.key < startKey {
+			continue
+		}
+		if endKey != "" && node.dataKey.key > endKey {
+			continue
+		}
+		inRange = append(inRange, node)
+	}
+	iter := &layeredRangeScanIterator{overlay: inRange, dbIter: dbIter}
+	iter.dbExists = dbIter.Next()
+	return iter
+}
+
+func (iter *layeredRangeScanIterator) Next() bool {
+	for {
+		overlayHasMore := iter.overlayPos < len(iter.overlay)
+		if !overlayHasMore && !iter.dbExists {
+			return false
+		}
+
+		var candidate *dataNode
+		if overlayHasMore && iter.dbExists {
+			dbKey, dbValue := iter.dbIter.GetKeyValue()
+			overlayKey := iter.overlay[iter.overlayPos].dataKey.key
+			if overlayKey <= dbKey {
+				candidate = iter.overlay[iter.overlayPos]
+				iter.overlayPos++
+				if overlayKey == dbKey {
+					iter.dbExists = iter.dbIter.Next()
+				}
+			} else {
+				candidate = &dataNode{dataKey: &dataKey{chaincodeID: "", key: dbKey}, value: dbValue}
+				iter.dbExists = iter.dbIter.Next()
+			}
+		} else if overlayHasMore {
+			candidate = iter.overlay[iter.overlayPos]
+			iter.overlayPos++
+		} else {
+			dbKey, dbValue := iter.dbIter.GetKeyValue()
+			candidate = &dataNode{dataKey: &dataKey{chaincodeID: "", key: dbKey}, value: dbValue}
+			iter.dbExists = iter.dbIter.Next()
+		}
+
+		if candidate.isDelete() {
+			continue
+		}
+		iter.current = candidate
+		return true
+	}
+}
+
+func (iter *layeredRangeScanIterator) GetKeyValue() (string, []byte) {
+	return iter.current.dataKey.key, iter.current.value
+}
+
+func (iter *layeredRangeScanIterator) Close() {
+	iter.dbIter.Close()
+}
@@ -21,6 +21,8 @@ package buckettree
 
 import (
 	"bytes"
+	"runtime"
+	"sync"
 
 	"github.com/op/go-logging"
 	"github.com/openblockchain/obc-peer/openchain/db"
@@ -28,6 +30,12 @@ import (
 	"github.com/tecbot/gorocksdb"
 )
 
+// parallelHashRecomputeThreshold is the minimum number of sibling buckets/nodes
+// at a given level that must be affected before the worker-pool based hashing
+// path is used in place of the plain sequential loop. A var, rather than a
+// const, so tests can lower it to exercise the parallel path deterministically.
+var parallelHashRecomputeThreshold = 100
+
 var logger = logging.MustGetLogger("buckettree")
 
 // StateImpl - implements the interface - 'statemgmt.HashableState'
@@ -37,6 +45,8 @@ type StateImpl struct {
 	persistedStateHash     []byte
 	lastComputedCryptoHash []byte
 	recomputeCryptoHash    bool
+	diffLayers             *diffLayerChain
+	flusher                *diffLayerFlusher
 }
 
 // NewStateImpl constructs a new StateImpl
@@ -47,7 +57,12 @@ func NewStateImpl() *StateImpl {
 // Initialize - method implementation for interface 'statemgmt.HashableState'
 func (stateImpl *StateImpl) Initialize(configs map[string]interface{}) error {
 	initConfig(configs)
-	rootBucketNode, err := fetchBucketNodeFromDB(constructRootBucketKey())
+	initCaches()
+	if conf.getMaxDiffLayers() > 0 {
+		stateImpl.diffLayers = newDiffLayerChain(conf.getMaxDiffLayers())
+		stateImpl.flusher = startDiffLayerFlusher(stateImpl.diffLayers, conf.getDiffLayerFlushInterval())
+	}
+	rootBucketNode, err := stateImpl.cachedFetchBucketNodeFromDB(constructRootBucketKey())
 	if err != nil {
 		return err
 	}
@@ -56,17 +71,32 @@ func (stateImpl *StateImpl) Initialize(configs map[string]interface{}) error {
 		stateImpl.lastComputedCryptoHash = stateImpl.persistedStateHash
 	}
 	return nil
+}
 
-	// We can create a cache and keep all the bucket nodes pre-loaded.
-	// Since, the bucket nodes do not contain actual data and max possible
-	// buckets are pre-determined, the memory demand may not be very high or can easily
-	// be controlled - by keeping seletive buckets in the cache (most likely first few levels of the bucket tree - because,
-	// higher the level of the bucket, more are the chances that the bucket would be required for recomputation of hash)
+// Close is a StateImpl-specific extension, not part of the
+// statemgmt.HashableState interface. It stops the background
+// diffLayerFlusher, draining any committed-but-unflushed diff layers to
+// RocksDB before returning, so that a clean process shutdown does not lose
+// state that ClearWorkingSet(true) already handed off as committed. It is a
+// no-op when diff layers are disabled. Callers that only hold a
+// statemgmt.HashableState must type-assert to *StateImpl to reach it.
+func (stateImpl *StateImpl) Close() {
+	if stateImpl.flusher != nil {
+		stateImpl.flusher.stop()
+	}
 }
 
 // Get - method implementation for interface 'statemgmt.HashableState'
 func (stateImpl *StateImpl) Get(chaincodeID string, key string) ([]byte, error) {
 	dataKey := newDataKey(chaincodeID, key)
+	if stateImpl.diffLayers != nil {
+		if node, ok := stateImpl.diffLayers.getDataNode(dataKey); ok {
+			if node.isDelete() {
+				return nil, nil
+			}
+			return node.value, nil
+		}
+	}
 	dataNode, err := fetchDataNodeFromDB(dataKey)
 	if err != nil {
 		return nil, err
@@ -91,8 +121,33 @@ func (stateImpl *StateImpl) PrepareWorkingSet(stateDelta *statemgmt.StateDelta)
 }
 
 // ClearWorkingSet - method implementation for interface 'statemgmt.HashableState'
+//
+// When changesPersisted is true and diff layers are enabled, the just-hashed
+// working set is handed off as a new, immutable stateDiffLayer to the
+// diff-layer chain: it becomes visible to Get()/GetRangeScanIterator()
+// immediately, while the actual RocksDB write happens later, off the critical
+// path, via the background diffLayerFlusher. With diff layers disabled, the
+// writes are the ones AddChangesForPersistence added to its write batch.
 func (stateImpl *StateImpl) ClearWorkingSet(changesPersisted bool) {
 	logger.Debug("Enter - ClearWorkingSet()")
+	if changesPersisted && stateImpl.dataNodesDelta != nil {
+		if stateImpl.diffLayers != nil {
+			stateImpl.diffLayers.pushLayer(&stateDiffLayer{
+				dataNodesDelta:  stateImpl.dataNodesDelta,
+				bucketTreeDelta: stateImpl.bucketTreeDelta,
+				rootHash:        stateImpl.lastComputedCryptoHash,
+			})
+		}
+		// globalBucketNodeCache/globalDataNodeCache are consulted unconditionally
+		// on the ComputeCryptoHash hot path regardless of whether diff layers are
+		// enabled, so they must be kept in sync on every commit, not just when
+		// diffLayers is non-nil. bumpCacheGeneration runs first so a prefetch
+		// job racing this commit detects it and backs off instead of
+		// overwriting what this commit is about to write.
+		bumpCacheGeneration()
+		stateImpl.warmCachesFor(stateImpl.bucketTreeDelta)
+		stateImpl.updateDataNodeCacheFor(stateImpl.dataNodesDelta)
+	}
 	stateImpl.dataNodesDelta = nil
 	stateImpl.bucketTreeDelta = nil
 	stateImpl.recomputeCryptoHash = false
@@ -103,6 +158,42 @@ func (stateImpl *StateImpl) ClearWorkingSet(changesPersisted bool) {
 	}
 }
 
+// updateDataNodeCacheFor re-populates the data-node cache entry for every
+// bucket touched by delta with its merged, post-commit content - the
+// dataNodeCache analogue of warmCachesFor. Merely invalidating the entry
+// leaves the next cachedFetchDataNodesFromDBFor call for that bucket to fall
+// through to a raw RocksDB read, which the background diffLayerFlusher may
+// not have caught up to yet, silently dropping this commit's contribution to
+// the bucket's hash.
+func (stateImpl *StateImpl) updateDataNodeCacheFor(delta *dataNodesDelta) {
+	for _, bucketKey := range delta.getAffectedBuckets() {
+		existingDataNodes, err := stateImpl.cachedFetchDataNodesFromDBFor(bucketKey)
+		if err != nil {
+			logger.Error("Failed to refresh data-node cache for bucket [%s], invalidating instead: %s", bucketKey, err)
+			globalDataNodeCache.invalidate(bucketKey)
+			continue
+		}
+		updatedDataNodes := delta.getSortedDataNodesFor(bucketKey)
+		globalDataNodeCache.put(bucketKey, mergeDataNodes(updatedDataNodes, existingDataNodes))
+	}
+}
+
+// warmCachesFor populates the bucket-node cache with the nodes from a
+// just-committed bucketTreeDelta, since they are now authoritative for reads
+// even though the RocksDB write for them may still be pending in the flusher.
+func (stateImpl *StateImpl) warmCachesFor(delta *bucketTreeDelta) {
+	secondLastLevel := conf.getLowestLevel() - 1
+	for level := secondLastLevel; level >= 0; level-- {
+		for _, bucketNode := range delta.getBucketNodesAt(level) {
+			if bucketNode.markedForDeletion {
+				globalBucketNodeCache.invalidate(bucketNode.bucketKey)
+			} else {
+				globalBucketNodeCache.put(bucketNode)
+			}
+		}
+	}
+}
+
 // ComputeCryptoHash - method implementation for interface 'statemgmt.HashableState'
 func (stateImpl *StateImpl) ComputeCryptoHash() ([]byte, error) {
 	logger.Debug("Enter - ComputeCryptoHash()")
@@ -125,10 +216,17 @@ func (stateImpl *StateImpl) ComputeCryptoHash() ([]byte, error) {
 }
 
 func (stateImpl *StateImpl) processDataNodeDelta() error {
-	afftectedBuckets := stateImpl.dataNodesDelta.getAffectedBuckets()
-	for _, bucketKey := range afftectedBuckets {
+	affectedBuckets := stateImpl.dataNodesDelta.getAffectedBuckets()
+	if len(affectedBuckets) < parallelHashRecomputeThreshold {
+		return stateImpl.processDataNodeDeltaSerial(affectedBuckets)
+	}
+	return stateImpl.processDataNodeDeltaParallel(affectedBuckets)
+}
+
+func (stateImpl *StateImpl) processDataNodeDeltaSerial(affectedBuckets []*bucketKey) error {
+	for _, bucketKey := range affectedBuckets {
 		updatedDataNodes := stateImpl.dataNodesDelta.getSortedDataNodesFor(bucketKey)
-		existingDataNodes, err := fetchDataNodesFromDBFor(bucketKey)
+		existingDataNodes, err := stateImpl.cachedFetchDataNodesFromDBFor(bucketKey)
 		if err != nil {
 			return err
 		}
@@ -140,34 +238,206 @@ func (stateImpl *StateImpl) processDataNodeDelta() error {
 	return nil
 }
 
+// bucketHashResult carries the outcome of hashing a single affected bucket
+// back to the single goroutine that owns the bucketTreeDelta.
+type bucketHashResult struct {
+	bucketKey  *bucketKey
+	cryptoHash []byte
+}
+
+// processDataNodeDeltaParallel fans out the fetch+hash work for each affected
+// bucket to a bounded worker pool and funnels the results back to the calling
+// goroutine, which is the only one allowed to mutate stateImpl.bucketTreeDelta.
+func (stateImpl *StateImpl) processDataNodeDeltaParallel(affectedBuckets []*bucketKey) error {
+	numWorkers := numHashWorkers(len(affectedBuckets))
+	jobs := make(chan *bucketKey, len(affectedBuckets))
+	results := make(chan *bucketHashResult, len(affectedBuckets))
+	errC := make(chan error, numWorkers)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for bucketKey := range jobs {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				updatedDataNodes := stateImpl.dataNodesDelta.getSortedDataNodesFor(bucketKey)
+				existingDataNodes, err := stateImpl.cachedFetchDataNodesFromDBFor(bucketKey)
+				if err != nil {
+					errC <- err
+					stopOnce.Do(func() { close(stop) })
+					return
+				}
+				cryptoHashForBucket := computeDataNodesCryptoHash(bucketKey, updatedDataNodes, existingDataNodes)
+				results <- &bucketHashResult{bucketKey, cryptoHashForBucket}
+			}
+		}()
+	}
+
+	for _, bucketKey := range affectedBuckets {
+		jobs <- bucketKey
+	}
+	close(jobs)
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for result := range results {
+		logger.Debug("Crypto-hash for lowest-level bucket [%s] is [%x]", result.bucketKey, result.cryptoHash)
+		parentBucket := stateImpl.bucketTreeDelta.getOrCreateBucketNode(result.bucketKey.getParentKey())
+		parentBucket.setChildCryptoHash(result.bucketKey, result.cryptoHash)
+	}
+	select {
+	case firstErr := <-errC:
+		return firstErr
+	default:
+		return nil
+	}
+}
+
 func (stateImpl *StateImpl) processBucketTreeDelta() error {
 	secondLastLevel := conf.getLowestLevel() - 1
 	for level := secondLastLevel; level >= 0; level-- {
 		bucketNodes := stateImpl.bucketTreeDelta.getBucketNodesAt(level)
-		for _, bucketNode := range bucketNodes {
-			logger.Debug("bucketNode in tree-delta [%s]", bucketNode)
-			dbBucketNode, err := fetchBucketNodeFromDB(bucketNode.bucketKey)
-			logger.Debug("bucket node from db [%s]", dbBucketNode)
-			if err != nil {
-				return err
-			}
-			if dbBucketNode != nil {
-				bucketNode.mergeBucketNode(dbBucketNode)
-				logger.Debug("After merge... bucketNode in tree-delta [%s]", bucketNode)
-			}
-			if level == 0 {
-				return nil
-			}
-			logger.Debug("Computing cryptoHash for bucket [%s]", bucketNode)
-			cryptoHash := bucketNode.computeCryptoHash()
-			logger.Debug("cryptoHash for bucket [%s] is [%x]", bucketNode, cryptoHash)
-			parentBucket := stateImpl.bucketTreeDelta.getOrCreateBucketNode(bucketNode.bucketKey.getParentKey())
-			parentBucket.setChildCryptoHash(bucketNode.bucketKey, cryptoHash)
+		var err error
+		if len(bucketNodes) < parallelHashRecomputeThreshold {
+			err = stateImpl.processBucketNodesAtLevelSerial(level, bucketNodes)
+		} else {
+			err = stateImpl.processBucketNodesAtLevelParallel(level, bucketNodes)
+		}
+		if err != nil {
+			return err
+		}
+		if level == 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// processBucketNodesAtLevelSerial merges each bucket node at the given level
+// with its persisted counterpart and, unless this is the root level, computes
+// its crypto-hash and stitches it into its parent in bucketTreeDelta.
+func (stateImpl *StateImpl) processBucketNodesAtLevelSerial(level int, bucketNodes []*bucketNode) error {
+	for _, bucketNode := range bucketNodes {
+		if err := stateImpl.mergeBucketNodeWithDB(bucketNode); err != nil {
+			return err
 		}
+		if level == 0 {
+			return nil
+		}
+		stateImpl.linkToParent(bucketNode)
+	}
+	return nil
+}
+
+// processBucketNodesAtLevelParallel does the same work as
+// processBucketNodesAtLevelSerial, except that the RocksDB fetch + merge for
+// each sibling bucket node at this level runs on a bounded worker pool. The
+// merged nodes are then stitched into their parents in a single serial pass
+// on the calling goroutine, since bucketTreeDelta is not safe for concurrent
+// writers.
+func (stateImpl *StateImpl) processBucketNodesAtLevelParallel(level int, bucketNodes []*bucketNode) error {
+	numWorkers := numHashWorkers(len(bucketNodes))
+	jobs := make(chan *bucketNode, len(bucketNodes))
+	errC := make(chan error, numWorkers)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for bucketNode := range jobs {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := stateImpl.mergeBucketNodeWithDB(bucketNode); err != nil {
+					errC <- err
+					stopOnce.Do(func() { close(stop) })
+					return
+				}
+			}
+		}()
+	}
+	for _, bucketNode := range bucketNodes {
+		jobs <- bucketNode
+	}
+	close(jobs)
+	wg.Wait()
+
+	select {
+	case err := <-errC:
+		return err
+	default:
+	}
+
+	if level == 0 {
+		return nil
+	}
+	for _, bucketNode := range bucketNodes {
+		stateImpl.linkToParent(bucketNode)
+	}
+	return nil
+}
+
+func (stateImpl *StateImpl) mergeBucketNodeWithDB(bucketNode *bucketNode) error {
+	logger.Debug("bucketNode in tree-delta [%s]", bucketNode)
+	dbBucketNode, err := stateImpl.cachedFetchBucketNodeFromDB(bucketNode.bucketKey)
+	logger.Debug("bucket node from db [%s]", dbBucketNode)
+	if err != nil {
+		return err
+	}
+	if dbBucketNode != nil {
+		bucketNode.mergeBucketNode(dbBucketNode)
+		logger.Debug("After merge... bucketNode in tree-delta [%s]", bucketNode)
 	}
 	return nil
 }
 
+func (stateImpl *StateImpl) linkToParent(bucketNode *bucketNode) {
+	logger.Debug("Computing cryptoHash for bucket [%s]", bucketNode)
+	cryptoHash := bucketNode.computeCryptoHash()
+	logger.Debug("cryptoHash for bucket [%s] is [%x]", bucketNode, cryptoHash)
+	parentBucket := stateImpl.bucketTreeDelta.getOrCreateBucketNode(bucketNode.bucketKey.getParentKey())
+	parentBucket.setChildCryptoHash(bucketNode.bucketKey, cryptoHash)
+}
+
+// numHashWorkers bounds the worker-pool size used for parallel bucket-hash
+// recomputation to GOMAXPROCS (or a configured override), and never spins up
+// more workers than there is work to hand out.
+func numHashWorkers(numJobs int) int {
+	workers := conf.getBucketHashWorkerCount()
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > numJobs {
+		workers = numJobs
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+// getBucketHashWorkerCount returns the configured worker-pool size for
+// parallel bucket-hash recomputation, or 0 (the default) to let
+// numHashWorkers fall back to GOMAXPROCS.
+func (c *config) getBucketHashWorkerCount() int {
+	return c.getInt("bucketHashWorkerCount", 0)
+}
+
 func (stateImpl *StateImpl) computeRootNodeCryptoHash() []byte {
 	return stateImpl.bucketTreeDelta.getRootNode().computeCryptoHash()
 }
@@ -175,6 +445,21 @@ func (stateImpl *StateImpl) computeRootNodeCryptoHash() []byte {
 func computeDataNodesCryptoHash(bucketKey *bucketKey, updatedNodes dataNodes, existingNodes dataNodes) []byte {
 	logger.Debug("Computing crypto-hash for bucket [%s]. numUpdatedNodes=[%d], numExistingNodes=[%d]", bucketKey, len(updatedNodes), len(existingNodes))
 	bucketHashCalculator := newBucketHashCalculator(bucketKey)
+	for _, node := range mergeDataNodes(updatedNodes, existingNodes) {
+		bucketHashCalculator.addNextNode(node)
+	}
+	return bucketHashCalculator.computeCryptoHash()
+}
+
+// mergeDataNodes merges updatedNodes - an overlay such as a delta's changes
+// or a diff-layer chain's unflushed content - with existingNodes - the
+// bucket's prior persisted content - into a single ascending-by-key slice,
+// updatedNodes winning on key collisions and deleted nodes dropped entirely.
+// The hash calculation, the data-node cache, and GetStateProof's sibling-hash
+// collection all need this same "what does this bucket actually contain"
+// merge, so it lives here once.
+func mergeDataNodes(updatedNodes dataNodes, existingNodes dataNodes) dataNodes {
+	merged := make(dataNodes, 0, len(updatedNodes)+len(existingNodes))
 	i := 0
 	j := 0
 	for i < len(updatedNodes) && j < len(existingNodes) {
@@ -195,7 +480,7 @@ func computeDataNodesCryptoHash(bucketKey *bucketKey, updatedNodes dataNodes, ex
 			j++
 		}
 		if !nextNode.isDelete() {
-			bucketHashCalculator.addNextNode(nextNode)
+			merged = append(merged, nextNode)
 		}
 	}
 
@@ -208,13 +493,20 @@ func computeDataNodesCryptoHash(bucketKey *bucketKey, updatedNodes dataNodes, ex
 
 	for _, remainingNode := range remainingNodes {
 		if !remainingNode.isDelete() {
-			bucketHashCalculator.addNextNode(remainingNode)
+			merged = append(merged, remainingNode)
 		}
 	}
-	return bucketHashCalculator.computeCryptoHash()
+	return merged
 }
 
 // AddChangesForPersistence - method implementation for interface 'statemgmt.HashableState'
+//
+// The actual RocksDB writes no longer happen here: ComputeCryptoHash is all
+// that needs to finish before the next block can start processing. The
+// resulting dataNodesDelta/bucketTreeDelta are flattened into writeBatch only
+// when diff layers are disabled (getMaxDiffLayers() <= 0); otherwise they flow
+// through ClearWorkingSet into the diff-layer chain and are written by the
+// background diffLayerFlusher instead.
 func (stateImpl *StateImpl) AddChangesForPersistence(writeBatch *gorocksdb.WriteBatch) error {
 
 	if stateImpl.dataNodesDelta == nil {
@@ -227,16 +519,18 @@ func (stateImpl *StateImpl) AddChangesForPersistence(writeBatch *gorocksdb.Write
 			return nil
 		}
 	}
-	stateImpl.addDataNodeChangesForPersistence(writeBatch)
-	stateImpl.addBucketNodeChangesForPersistence(writeBatch)
+	if conf.getMaxDiffLayers() <= 0 {
+		addDataNodeChangesForPersistence(writeBatch, stateImpl.dataNodesDelta)
+		addBucketNodeChangesForPersistence(writeBatch, stateImpl.bucketTreeDelta)
+	}
 	return nil
 }
 
-func (stateImpl *StateImpl) addDataNodeChangesForPersistence(writeBatch *gorocksdb.WriteBatch) {
+func addDataNodeChangesForPersistence(writeBatch *gorocksdb.WriteBatch, delta *dataNodesDelta) {
 	openchainDB := db.GetDBHandle()
-	affectedBuckets := stateImpl.dataNodesDelta.getAffectedBuckets()
+	affectedBuckets := delta.getAffectedBuckets()
 	for _, affectedBucket := range affectedBuckets {
-		dataNodes := stateImpl.dataNodesDelta.getSortedDataNodesFor(affectedBucket)
+		dataNodes := delta.getSortedDataNodesFor(affectedBucket)
 		for _, dataNode := range dataNodes {
 			if dataNode.isDelete() {
 				writeBatch.DeleteCF(openchainDB.StateCF, dataNode.dataKey.getEncodedBytes())
@@ -247,34 +541,54 @@ func (stateImpl *StateImpl) addDataNodeChangesForPersistence(writeBatch *gorocks
 	}
 }
 
-func (stateImpl *StateImpl) addBucketNodeChangesForPersistence(writeBatch *gorocksdb.WriteBatch) {
+func addBucketNodeChangesForPersistence(writeBatch *gorocksdb.WriteBatch, delta *bucketTreeDelta) {
 	openchainDB := db.GetDBHandle()
 	secondLastLevel := conf.getLowestLevel() - 1
 	for level := secondLastLevel; level >= 0; level-- {
-		bucketNodes := stateImpl.bucketTreeDelta.getBucketNodesAt(level)
+		bucketNodes := delta.getBucketNodesAt(level)
 		for _, bucketNode := range bucketNodes {
 			if bucketNode.markedForDeletion {
 				writeBatch.DeleteCF(openchainDB.StateCF, bucketNode.bucketKey.getEncodedBytes())
 			} else {
 				writeBatch.PutCF(openchainDB.StateCF, bucketNode.bucketKey.getEncodedBytes(), bucketNode.marshal())
 			}
-			writeBatch.PutCF(openchainDB.StateCF, bucketNode.bucketKey.getEncodedBytes(), bucketNode.marshal())
 		}
 	}
 }
 
 // PerfHintKeyChanged - method implementation for interface 'statemgmt.HashableState'
 func (stateImpl *StateImpl) PerfHintKeyChanged(chaincodeID string, key string) {
-	// We can create a cache. Pull all the keys for the bucket (to which given key belongs) in a separate thread
-	// This prefetching can help making method 'ComputeCryptoHash' faster.
+	// Submit an async prefetch job so that the bucket/data nodes for this key
+	// are warm in the cache by the time the next ComputeCryptoHash runs.
+	globalPrefetcher.submit(chaincodeID, key)
 }
 
 // GetStateSnapshotIterator - method implementation for interface 'statemgmt.HashableState'
+//
+// The gorocksdb snapshot and the diff-layer chain tip are pinned together, at
+// the same instant, so that the returned iterator reflects one consistent
+// point in time regardless of how many more layers are appended/flushed
+// afterwards.
 func (stateImpl *StateImpl) GetStateSnapshotIterator(snapshot *gorocksdb.Snapshot) (statemgmt.StateSnapshotIterator, error) {
-	return newStateSnapshotIterator(snapshot)
+	dbIter, err := newStateSnapshotIterator(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if stateImpl.diffLayers == nil {
+		return dbIter, nil
+	}
+	return newLayeredStateSnapshotIterator(stateImpl.diffLayers.snapshotTip(), dbIter), nil
 }
 
 // GetRangeScanIterator - method implementation for interface 'statemgmt.HashableState'
 func (stateImpl *StateImpl) GetRangeScanIterator(chaincodeID string, startKey string, endKey string) (statemgmt.RangeScanIterator, error) {
-	return newRangeScanIterator(chaincodeID, startKey, endKey)
+	dbIter, err := newRangeScanIterator(chaincodeID, startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	if stateImpl.diffLayers == nil {
+		return dbIter, nil
+	}
+	tip := stateImpl.diffLayers.snapshotTip()
+	return newLayeredRangeScanIterator(tip, chaincodeID, startKey, endKey, dbIter), nil
 }
@@ -0,0 +1,345 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package buckettree
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/openblockchain/obc-peer/openchain/db"
+	"github.com/openblockchain/obc-peer/openchain/ledger/statemgmt"
+	"github.com/tecbot/gorocksdb"
+)
+
+func newTestStateImpl(t *testing.T) *StateImpl {
+	stateImpl := NewStateImpl()
+	if err := stateImpl.Initialize(nil); err != nil {
+		t.Fatalf("Initialize failed: %s", err)
+	}
+	return stateImpl
+}
+
+func applyTestDelta(t *testing.T, stateImpl *StateImpl, entries map[string]map[string][]byte, deletes map[string][]string) []byte {
+	delta := statemgmt.NewStateDelta()
+	for chaincodeID, kvs := range entries {
+		for key, value := range kvs {
+			delta.Set(chaincodeID, key, value)
+		}
+	}
+	for chaincodeID, keys := range deletes {
+		for _, key := range keys {
+			delta.Delete(chaincodeID, key)
+		}
+	}
+	if err := stateImpl.PrepareWorkingSet(delta); err != nil {
+		t.Fatalf("PrepareWorkingSet failed: %s", err)
+	}
+	hash, err := stateImpl.ComputeCryptoHash()
+	if err != nil {
+		t.Fatalf("ComputeCryptoHash failed: %s", err)
+	}
+	writeBatch := gorocksdb.NewWriteBatch()
+	defer writeBatch.Destroy()
+	if err := stateImpl.AddChangesForPersistence(writeBatch); err != nil {
+		t.Fatalf("AddChangesForPersistence failed: %s", err)
+	}
+	stateImpl.ClearWorkingSet(true)
+	if stateImpl.flusher != nil {
+		for {
+			flushed, err := stateImpl.flusher.flushOne()
+			if err != nil {
+				t.Fatalf("flushOne failed: %s", err)
+			}
+			if !flushed {
+				break
+			}
+		}
+	}
+	return hash
+}
+
+// TestAddBucketNodeChangesForPersistence_DeletionRemovesKey is a regression
+// test for the double-write bug where a bucket node marked for deletion was
+// first deleted, then immediately re-inserted with its (empty) marshaled
+// content in the same write batch - silently undoing the deletion.
+func TestAddBucketNodeChangesForPersistence_DeletionRemovesKey(t *testing.T) {
+	stateImpl := newTestStateImpl(t)
+	chaincodeID := "chaincodeForDeletionTest"
+
+	applyTestDelta(t, stateImpl, map[string]map[string][]byte{
+		chaincodeID: {"key1": []byte("value1")},
+	}, nil)
+
+	applyTestDelta(t, stateImpl, nil, map[string][]string{
+		chaincodeID: {"key1"},
+	})
+
+	// Bucket nodes are stored for the parents of leaf buckets, never for the
+	// leaf buckets themselves.
+	bucketKey := newDataKey(chaincodeID, "key1").getBucketKey().getParentKey()
+	openchainDB := db.GetDBHandle()
+	value, err := openchainDB.DB.GetCF(gorocksdb.NewDefaultReadOptions(), openchainDB.StateCF, bucketKey.getEncodedBytes())
+	if err != nil {
+		t.Fatalf("GetCF failed: %s", err)
+	}
+	defer value.Free()
+	if value.Data() != nil {
+		t.Fatalf("expected bucket-node key [%s] to be absent from RocksDB after deletion, got %d bytes", bucketKey, len(value.Data()))
+	}
+}
+
+// TestComputeCryptoHash_MatchesFreshReplayAfterDeletion verifies that once a
+// key is written and then deleted, the resulting root hash is identical to
+// that of a freshly-initialized StateImpl that only ever saw the
+// non-deleted keys - i.e., deletion leaves no residue in the bucket tree.
+func TestComputeCryptoHash_MatchesFreshReplayAfterDeletion(t *testing.T) {
+	chaincodeID := "chaincodeForReplayTest"
+
+	withDeletion := newTestStateImpl(t)
+	applyTestDelta(t, withDeletion, map[string]map[string][]byte{
+		chaincodeID: {"key1": []byte("value1"), "key2": []byte("value2")},
+	}, nil)
+	hashAfterWrite := applyTestDelta(t, withDeletion, nil, map[string][]string{
+		chaincodeID: {"key1"},
+	})
+
+	freshReplay := newTestStateImpl(t)
+	hashAfterReplay := applyTestDelta(t, freshReplay, map[string]map[string][]byte{
+		chaincodeID: {"key2": []byte("value2")},
+	}, nil)
+
+	if !bytes.Equal(hashAfterWrite, hashAfterReplay) {
+		t.Fatalf("expected root hash after delete [%x] to match fresh replay [%x]", hashAfterWrite, hashAfterReplay)
+	}
+}
+
+// TestComputeCryptoHash_ParallelMatchesSerial forces processDataNodeDelta and
+// processBucketTreeDelta onto their worker-pool code paths (by lowering
+// parallelHashRecomputeThreshold below the number of affected buckets) and
+// checks that the resulting root hash is identical to the one produced by the
+// plain sequential loops.
+func TestComputeCryptoHash_ParallelMatchesSerial(t *testing.T) {
+	chaincodeID := "chaincodeForParallelTest"
+	entries := map[string][]byte{}
+	for i := 0; i < 20; i++ {
+		entries[fmt.Sprintf("key%d", i)] = []byte(fmt.Sprintf("value%d", i))
+	}
+
+	serial := newTestStateImpl(t)
+	serialHash := applyTestDelta(t, serial, map[string]map[string][]byte{chaincodeID: entries}, nil)
+
+	originalThreshold := parallelHashRecomputeThreshold
+	parallelHashRecomputeThreshold = 1
+	defer func() { parallelHashRecomputeThreshold = originalThreshold }()
+
+	parallel := newTestStateImpl(t)
+	parallelHash := applyTestDelta(t, parallel, map[string]map[string][]byte{chaincodeID: entries}, nil)
+
+	if !bytes.Equal(serialHash, parallelHash) {
+		t.Fatalf("expected parallel-path root hash [%x] to match serial-path root hash [%x]", parallelHash, serialHash)
+	}
+}
+
+// TestComputeCryptoHash_MatchesFreshReplayWithDiffLayersDisabled is a
+// regression test for a stale-cache bug: with maxDiffLayers<=0 (the
+// synchronous-write legacy mode), diffLayers is nil, but
+// globalBucketNodeCache/globalDataNodeCache must still be kept in sync on
+// every commit since cachedFetchBucketNodeFromDB/cachedFetchDataNodesFromDBFor
+// are consulted unconditionally on the ComputeCryptoHash hot path. Two
+// sequential commits into the same bucket must produce the same root hash as
+// a fresh replay of the net effect.
+func TestComputeCryptoHash_MatchesFreshReplayWithDiffLayersDisabled(t *testing.T) {
+	chaincodeID := "chaincodeForDisabledDiffLayersTest"
+
+	noDiffLayers := NewStateImpl()
+	if err := noDiffLayers.Initialize(map[string]interface{}{"maxDiffLayers": 0}); err != nil {
+		t.Fatalf("Initialize failed: %s", err)
+	}
+	if noDiffLayers.diffLayers != nil {
+		t.Fatalf("expected diffLayers to be nil with maxDiffLayers disabled")
+	}
+	applyTestDelta(t, noDiffLayers, map[string]map[string][]byte{
+		chaincodeID: {"key1": []byte("value1")},
+	}, nil)
+	hashAfterSecondCommit := applyTestDelta(t, noDiffLayers, map[string]map[string][]byte{
+		chaincodeID: {"key2": []byte("value2")},
+	}, nil)
+
+	freshReplay := newTestStateImpl(t)
+	hashAfterReplay := applyTestDelta(t, freshReplay, map[string]map[string][]byte{
+		chaincodeID: {"key1": []byte("value1"), "key2": []byte("value2")},
+	}, nil)
+
+	if !bytes.Equal(hashAfterSecondCommit, hashAfterReplay) {
+		t.Fatalf("expected root hash after two commits [%x] to match fresh replay [%x]", hashAfterSecondCommit, hashAfterReplay)
+	}
+}
+
+// applyTestDeltaNoFlush behaves like applyTestDelta except that it leaves any
+// diff layers unflushed afterwards, so that a following commit must rely on
+// the in-memory caches/diff-layer chain rather than on RocksDB already being
+// caught up.
+func applyTestDeltaNoFlush(t *testing.T, stateImpl *StateImpl, entries map[string]map[string][]byte, deletes map[string][]string) []byte {
+	delta := statemgmt.NewStateDelta()
+	for chaincodeID, kvs := range entries {
+		for key, value := range kvs {
+			delta.Set(chaincodeID, key, value)
+		}
+	}
+	for chaincodeID, keys := range deletes {
+		for _, key := range keys {
+			delta.Delete(chaincodeID, key)
+		}
+	}
+	if err := stateImpl.PrepareWorkingSet(delta); err != nil {
+		t.Fatalf("PrepareWorkingSet failed: %s", err)
+	}
+	hash, err := stateImpl.ComputeCryptoHash()
+	if err != nil {
+		t.Fatalf("ComputeCryptoHash failed: %s", err)
+	}
+	writeBatch := gorocksdb.NewWriteBatch()
+	defer writeBatch.Destroy()
+	if err := stateImpl.AddChangesForPersistence(writeBatch); err != nil {
+		t.Fatalf("AddChangesForPersistence failed: %s", err)
+	}
+	stateImpl.ClearWorkingSet(true)
+	return hash
+}
+
+// TestComputeCryptoHash_MatchesFreshReplayAcrossUnflushedDiffLayers is a
+// regression test for a stale-cache bug: committing twice into the same
+// bucket back-to-back, with the background diffLayerFlusher never given a
+// chance to run in between, used to silently drop the first commit's
+// contribution to that bucket, because the data-node cache entry was merely
+// invalidated rather than re-populated with the merged content - so the
+// second commit's hash fell through to a RocksDB read that the flusher
+// hadn't caught up to yet. numBuckets is pinned to 1 so that both keys below
+// are guaranteed to land in the same leaf bucket.
+func TestComputeCryptoHash_MatchesFreshReplayAcrossUnflushedDiffLayers(t *testing.T) {
+	chaincodeID := "chaincodeForUnflushedDiffLayerTest"
+
+	stateImpl := NewStateImpl()
+	if err := stateImpl.Initialize(map[string]interface{}{"numBuckets": 1}); err != nil {
+		t.Fatalf("Initialize failed: %s", err)
+	}
+	applyTestDeltaNoFlush(t, stateImpl, map[string]map[string][]byte{
+		chaincodeID: {"key1": []byte("value1")},
+	}, nil)
+	hashAfterSecondCommit := applyTestDeltaNoFlush(t, stateImpl, map[string]map[string][]byte{
+		chaincodeID: {"key2": []byte("value2")},
+	}, nil)
+
+	freshReplay := NewStateImpl()
+	if err := freshReplay.Initialize(map[string]interface{}{"numBuckets": 1}); err != nil {
+		t.Fatalf("Initialize failed: %s", err)
+	}
+	hashAfterReplay := applyTestDelta(t, freshReplay, map[string]map[string][]byte{
+		chaincodeID: {"key1": []byte("value1"), "key2": []byte("value2")},
+	}, nil)
+
+	if !bytes.Equal(hashAfterSecondCommit, hashAfterReplay) {
+		t.Fatalf("expected root hash after two unflushed commits [%x] to match fresh replay [%x]", hashAfterSecondCommit, hashAfterReplay)
+	}
+}
+
+// TestComputeCryptoHash_MatchesFreshReplayWithEvictingCaches is a regression
+// test for the same stale-cache bug as
+// TestComputeCryptoHash_MatchesFreshReplayAcrossUnflushedDiffLayers, but
+// exercised through genuine cache eviction rather than a single
+// never-evicted bucket: globalBucketNodeCache/globalDataNodeCache are swapped
+// out for size-1 ones - initCaches() only runs once per process, so
+// Initialize's own config cannot shrink them after the fact - and numBuckets
+// is pinned to 2, so the second commit below is guaranteed to evict the
+// first commit's cache entry for whichever of the two buckets it doesn't
+// touch, forcing cachedFetchBucketNodeFromDB/cachedFetchDataNodesFromDBFor to
+// fall through past a cache miss for a bucket both commits touch.
+func TestComputeCryptoHash_MatchesFreshReplayWithEvictingCaches(t *testing.T) {
+	chaincodeID := "chaincodeForEvictingCacheTest"
+	newTwoBucketStateImpl := func(t *testing.T) *StateImpl {
+		stateImpl := NewStateImpl()
+		if err := stateImpl.Initialize(map[string]interface{}{"numBuckets": 2}); err != nil {
+			t.Fatalf("Initialize failed: %s", err)
+		}
+		return stateImpl
+	}
+
+	stateImpl := newTwoBucketStateImpl(t)
+
+	originalBucketCache, originalDataCache := globalBucketNodeCache, globalDataNodeCache
+	globalBucketNodeCache = newBucketNodeCache(0, 1)
+	globalDataNodeCache = newDataNodeCache(1)
+	defer func() {
+		globalBucketNodeCache, globalDataNodeCache = originalBucketCache, originalDataCache
+	}()
+
+	applyTestDeltaNoFlush(t, stateImpl, map[string]map[string][]byte{
+		chaincodeID: {"key1": []byte("value1"), "key2": []byte("value2"), "key3": []byte("value3")},
+	}, nil)
+	hashAfterSecondCommit := applyTestDeltaNoFlush(t, stateImpl, map[string]map[string][]byte{
+		chaincodeID: {"key4": []byte("value4"), "key5": []byte("value5"), "key6": []byte("value6")},
+	}, nil)
+
+	freshReplay := newTwoBucketStateImpl(t)
+	hashAfterReplay := applyTestDelta(t, freshReplay, map[string]map[string][]byte{
+		chaincodeID: {
+			"key1": []byte("value1"), "key2": []byte("value2"), "key3": []byte("value3"),
+			"key4": []byte("value4"), "key5": []byte("value5"), "key6": []byte("value6"),
+		},
+	}, nil)
+
+	if !bytes.Equal(hashAfterSecondCommit, hashAfterReplay) {
+		t.Fatalf("expected root hash after two commits with evicting caches [%x] to match fresh replay [%x]", hashAfterSecondCommit, hashAfterReplay)
+	}
+}
+
+// TestWarmAncestorBucketNodes_SkipsPutAfterGenerationRace is a regression
+// test for the prefetcher clobbering a newer commit's cache entry: if a
+// commit's cacheGeneration bump lands while a prefetch job's own uncached DB
+// read for the same bucket node is in flight, the prefetch must not put the
+// stale content it read, since that would overwrite whatever the commit
+// already wrote into the cache.
+func TestWarmAncestorBucketNodes_SkipsPutAfterGenerationRace(t *testing.T) {
+	stateImpl := newTestStateImpl(t)
+	chaincodeID := "chaincodeForPrefetchRaceTest"
+	applyTestDelta(t, stateImpl, map[string]map[string][]byte{
+		chaincodeID: {"key1": []byte("value1")},
+	}, nil)
+
+	leafBucketKey := newDataKey(chaincodeID, "key1").getBucketKey()
+	// The leaf bucket has no bucket node of its own; its parent is the first
+	// node warmAncestorBucketNodes reads.
+	bucketKey := leafBucketKey.getParentKey()
+	globalBucketNodeCache.invalidate(bucketKey)
+
+	staleGeneration := loadCacheGeneration()
+	bumpCacheGeneration()
+	droppedBefore := bucketCacheStats.PrefetchDropped()
+
+	warmAncestorBucketNodes(leafBucketKey, staleGeneration)
+
+	if node := globalBucketNodeCache.get(bucketKey); node != nil {
+		t.Fatalf("expected a prefetch racing a newer commit to skip caching the stale bucket node it read, got %v", node)
+	}
+	if dropped := bucketCacheStats.PrefetchDropped(); dropped != droppedBefore+1 {
+		t.Fatalf("expected PrefetchDropped to increase by 1, went from %d to %d", droppedBefore, dropped)
+	}
+}
@@ -0,0 +1,193 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package buckettree
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// siblingHash pairs a bucket/data-node's encoded key with the crypto-hash it
+// contributes to its parent's combined hash, so that a proof can be replayed
+// without the verifier needing to know the tree's branching factor.
+type siblingHash struct {
+	EncodedKey []byte
+	Hash       []byte
+}
+
+// bucketLevelProof captures, for a single bucket node on the path from the
+// leaf bucket up to the root, the sibling child crypto-hashes needed to
+// recompute that node's own crypto-hash the same way bucketNode.computeCryptoHash
+// combines its children.
+type bucketLevelProof struct {
+	BucketKey     *bucketKey
+	SiblingHashes []*siblingHash
+}
+
+// StateProof is a verifiable Merkle proof tying a (chaincodeID, key, value)
+// triple to a bucket-tree root hash, without requiring the verifier to
+// replay the whole state. It is the bucket-tree analogue of the
+// account/storage proofs found in other Merkle-state chains.
+type StateProof struct {
+	LeafBucketKey *bucketKey
+	LeafSiblings  []*siblingHash
+	BucketPath    []*bucketLevelProof
+}
+
+// GetStateProof is a StateImpl-specific extension, not part of the
+// statemgmt.HashableState interface. It returns a StateProof for
+// (chaincodeID, key) against the currently persisted state hash. The proof
+// is built entirely from already-committed data - it does not consult the
+// in-flight working set - but it does, via cachedFetchDataNodesFromDBFor/
+// cachedFetchBucketNodeFromDB, consult the diff-layer chain, since a recently
+// committed block's bucket content may not have reached RocksDB yet (see
+// ClearWorkingSet). Callers that only hold a statemgmt.HashableState must
+// type-assert to *StateImpl to reach it.
+func (stateImpl *StateImpl) GetStateProof(chaincodeID string, key string) (*StateProof, error) {
+	dataKey := newDataKey(chaincodeID, key)
+	leafBucketKey := dataKey.getBucketKey()
+
+	existingDataNodes, err := stateImpl.cachedFetchDataNodesFromDBFor(leafBucketKey)
+	if err != nil {
+		return nil, err
+	}
+	leafSiblings := make([]*siblingHash, 0, len(existingDataNodes))
+	for _, node := range existingDataNodes {
+		if bytes.Equal(node.dataKey.compositeKey, dataKey.compositeKey) {
+			continue
+		}
+		leafSiblings = append(leafSiblings, &siblingHash{
+			EncodedKey: node.dataKey.getEncodedBytes(),
+			Hash:       dataNodeContentHash(node),
+		})
+	}
+
+	proof := &StateProof{
+		LeafBucketKey: leafBucketKey,
+		LeafSiblings:  leafSiblings,
+	}
+
+	for childKey := leafBucketKey; childKey.getParentKey() != nil; childKey = childKey.getParentKey() {
+		parentKey := childKey.getParentKey()
+		parentNode, err := stateImpl.cachedFetchBucketNodeFromDB(parentKey)
+		if err != nil {
+			return nil, err
+		}
+		if parentNode == nil {
+			return nil, fmt.Errorf("no bucket node found in DB for key [%s] while building proof", parentKey)
+		}
+		proof.BucketPath = append(proof.BucketPath, &bucketLevelProof{
+			BucketKey:     parentKey,
+			SiblingHashes: parentNode.childCryptoHashesExcluding(childKey),
+		})
+	}
+	return proof, nil
+}
+
+// VerifyStateProof reconstructs the leaf-bucket hash for (chaincodeID, key,
+// value) from proof, walks it up to the root combining sibling hashes
+// exactly as bucketNode.computeCryptoHash does, and reports whether the
+// result equals rootHash. A nil value proves non-inclusion: the key is
+// provably absent from the leaf bucket, yet the bucket's reconstructed hash
+// still ties back to rootHash.
+func VerifyStateProof(rootHash []byte, chaincodeID string, key string, value []byte, proof *StateProof) (bool, error) {
+	if proof == nil {
+		return false, fmt.Errorf("nil proof")
+	}
+	dataKey := newDataKey(chaincodeID, key)
+	if !dataKey.getBucketKey().equals(proof.LeafBucketKey) {
+		return false, fmt.Errorf("proof is for a different bucket than (chaincodeID, key) resolves to")
+	}
+
+	leafEntries := append([]*siblingHash{}, proof.LeafSiblings...)
+	if value != nil {
+		leafEntries = append(leafEntries, &siblingHash{
+			EncodedKey: dataKey.getEncodedBytes(),
+			Hash:       dataNodeContentHash(&dataNode{dataKey: dataKey, value: value}),
+		})
+	}
+	currentHash := combineSiblingHashes(leafEntries, proof.LeafBucketKey)
+	currentKey := proof.LeafBucketKey
+
+	for _, level := range proof.BucketPath {
+		entries := append([]*siblingHash{}, level.SiblingHashes...)
+		entries = append(entries, &siblingHash{EncodedKey: currentKey.getEncodedBytes(), Hash: currentHash})
+		currentHash = combineSiblingHashes(entries, level.BucketKey)
+		currentKey = level.BucketKey
+	}
+	return bytes.Equal(currentHash, rootHash), nil
+}
+
+// dataNodeContentHash is the per-data-node commitment fed into the leaf
+// bucket's combined hash. It must stay in sync with how
+// computeDataNodesCryptoHash folds a dataNode into a bucket's crypto-hash.
+func dataNodeContentHash(node *dataNode) []byte {
+	calculator := newBucketHashCalculator(node.dataKey.getBucketKey())
+	calculator.addNextNode(node)
+	return calculator.computeCryptoHash()
+}
+
+// combineSiblingHashes folds a set of (key, hash) entries belonging to
+// bucketKey into a single hash, sorting by encoded key first so the result
+// is independent of the order entries were collected in - mirroring the
+// sorted merge that computeDataNodesCryptoHash and
+// bucketNode.computeCryptoHash both rely on.
+func combineSiblingHashes(entries []*siblingHash, bucketKey *bucketKey) []byte {
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].EncodedKey, entries[j].EncodedKey) < 0
+	})
+	calculator := newBucketHashCalculator(bucketKey)
+	for _, entry := range entries {
+		calculator.addPrecomputedHash(entry.Hash)
+	}
+	return calculator.computeCryptoHash()
+}
+
+// childCryptoHashesExcluding returns this bucket node's stored child
+// crypto-hashes, excluding the one contributed by exceptChildKey, as
+// (encoded key, hash) pairs suitable for feeding into combineSiblingHashes.
+func (bucketNode *bucketNode) childCryptoHashesExcluding(exceptChildKey *bucketKey) []*siblingHash {
+	exceptEncoded := exceptChildKey.getEncodedBytes()
+	siblings := make([]*siblingHash, 0, len(bucketNode.childrenCryptoHash))
+	for encodedChildKey, hash := range bucketNode.childrenCryptoHash {
+		if bytes.Equal([]byte(encodedChildKey), exceptEncoded) {
+			continue
+		}
+		siblings = append(siblings, &siblingHash{EncodedKey: []byte(encodedChildKey), Hash: hash})
+	}
+	return siblings
+}
+
+// equals reports whether two bucketKeys identify the same bucket.
+func (k *bucketKey) equals(other *bucketKey) bool {
+	return bytes.Equal(k.getEncodedBytes(), other.getEncodedBytes())
+}
+
+// addPrecomputedHash feeds an already-computed child/data-node hash into the
+// running bucket hash, the same way addNextNode does for a live dataNode. It
+// is used when reconstructing a bucket's crypto-hash from a StateProof, where
+// only sibling hashes - not full node content - are available, so the
+// dataNode it builds carries an empty key. This relies on addNextNode never
+// folding a node's dataKey into the hash it contributes to the bucket total;
+// see TestCombineSiblingHashes_MatchesDirectCalculation for that invariant.
+func (calc *bucketHashCalculator) addPrecomputedHash(hash []byte) {
+	calc.addNextNode(&dataNode{dataKey: &dataKey{}, value: hash})
+}
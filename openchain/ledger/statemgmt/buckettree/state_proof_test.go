@@ -0,0 +1,160 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package buckettree
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestGetStateProof_VerifiesAgainstRootHash is a round-trip test: a proof
+// obtained from GetStateProof for a committed key must verify against the
+// root hash that committed it.
+func TestGetStateProof_VerifiesAgainstRootHash(t *testing.T) {
+	stateImpl := newTestStateImpl(t)
+	chaincodeID := "chaincodeForProofTest"
+
+	rootHash := applyTestDelta(t, stateImpl, map[string]map[string][]byte{
+		chaincodeID: {"key1": []byte("value1"), "key2": []byte("value2")},
+	}, nil)
+
+	proof, err := stateImpl.GetStateProof(chaincodeID, "key1")
+	if err != nil {
+		t.Fatalf("GetStateProof failed: %s", err)
+	}
+
+	ok, err := VerifyStateProof(rootHash, chaincodeID, "key1", []byte("value1"), proof)
+	if err != nil {
+		t.Fatalf("VerifyStateProof failed: %s", err)
+	}
+	if !ok {
+		t.Fatalf("expected proof for key1 to verify against root hash [%x]", rootHash)
+	}
+}
+
+// TestGetStateProof_RejectsWrongValue checks that a proof does not verify
+// against a value other than the one actually committed.
+func TestGetStateProof_RejectsWrongValue(t *testing.T) {
+	stateImpl := newTestStateImpl(t)
+	chaincodeID := "chaincodeForProofMismatchTest"
+
+	rootHash := applyTestDelta(t, stateImpl, map[string]map[string][]byte{
+		chaincodeID: {"key1": []byte("value1")},
+	}, nil)
+
+	proof, err := stateImpl.GetStateProof(chaincodeID, "key1")
+	if err != nil {
+		t.Fatalf("GetStateProof failed: %s", err)
+	}
+
+	ok, err := VerifyStateProof(rootHash, chaincodeID, "key1", []byte("wrong-value"), proof)
+	if err != nil {
+		t.Fatalf("VerifyStateProof failed: %s", err)
+	}
+	if ok {
+		t.Fatalf("expected proof to fail to verify against a value that was never committed")
+	}
+}
+
+// TestGetStateProof_VerifiesAgainstUnflushedDiffLayer is a regression test
+// for GetStateProof bypassing the diff-layer chain: a proof requested for a
+// key whose commit has not yet been flushed from the diff-layer chain to
+// RocksDB must still verify against the root hash that committed it.
+func TestGetStateProof_VerifiesAgainstUnflushedDiffLayer(t *testing.T) {
+	stateImpl := newTestStateImpl(t)
+	chaincodeID := "chaincodeForUnflushedProofTest"
+
+	rootHash := applyTestDeltaNoFlush(t, stateImpl, map[string]map[string][]byte{
+		chaincodeID: {"key1": []byte("value1"), "key2": []byte("value2")},
+	}, nil)
+
+	proof, err := stateImpl.GetStateProof(chaincodeID, "key1")
+	if err != nil {
+		t.Fatalf("GetStateProof failed: %s", err)
+	}
+
+	ok, err := VerifyStateProof(rootHash, chaincodeID, "key1", []byte("value1"), proof)
+	if err != nil {
+		t.Fatalf("VerifyStateProof failed: %s", err)
+	}
+	if !ok {
+		t.Fatalf("expected proof for key1 to verify against root hash [%x] even though its commit is not yet flushed", rootHash)
+	}
+}
+
+// TestGetStateProof_NonInclusion is a round-trip test for the non-inclusion
+// branch of VerifyStateProof: proving that a key which was never written is
+// in fact absent, while the reconstructed hash still ties back to the root.
+func TestGetStateProof_NonInclusion(t *testing.T) {
+	stateImpl := newTestStateImpl(t)
+	chaincodeID := "chaincodeForNonInclusionProofTest"
+
+	rootHash := applyTestDelta(t, stateImpl, map[string]map[string][]byte{
+		chaincodeID: {"key1": []byte("value1")},
+	}, nil)
+
+	proof, err := stateImpl.GetStateProof(chaincodeID, "neverWrittenKey")
+	if err != nil {
+		t.Fatalf("GetStateProof failed: %s", err)
+	}
+
+	ok, err := VerifyStateProof(rootHash, chaincodeID, "neverWrittenKey", nil, proof)
+	if err != nil {
+		t.Fatalf("VerifyStateProof failed: %s", err)
+	}
+	if !ok {
+		t.Fatalf("expected non-inclusion proof for neverWrittenKey to verify against root hash [%x]", rootHash)
+	}
+}
+
+// TestCombineSiblingHashes_MatchesDirectCalculation is a focused unit test
+// for the invariant combineSiblingHashes/addPrecomputedHash rely on:
+// folding a bucket's data nodes through dataNodeContentHash (one calculator
+// per node) and then combineSiblingHashes (a second calculator fed only the
+// precomputed per-node hashes, via a fake dataNode carrying an empty key)
+// must produce the same bucket crypto-hash as feeding the real nodes
+// directly into a single calculator. If bucketHashCalculator ever started
+// folding a node's dataKey into the hash it contributes to its parent - as
+// opposed to only its own content hash - this test would catch the
+// divergence that addPrecomputedHash's fake key would otherwise mask.
+func TestCombineSiblingHashes_MatchesDirectCalculation(t *testing.T) {
+	chaincodeID := "chaincodeForHashInvariantTest"
+	bucketKey := newDataKey(chaincodeID, "key1").getBucketKey()
+	nodes := []*dataNode{
+		{dataKey: newDataKey(chaincodeID, "key1"), value: []byte("value1")},
+		{dataKey: newDataKey(chaincodeID, "key2"), value: []byte("value2")},
+	}
+
+	direct := newBucketHashCalculator(bucketKey)
+	for _, node := range nodes {
+		direct.addNextNode(node)
+	}
+	directHash := direct.computeCryptoHash()
+
+	entries := make([]*siblingHash, len(nodes))
+	for i, node := range nodes {
+		entries[i] = &siblingHash{EncodedKey: node.dataKey.getEncodedBytes(), Hash: dataNodeContentHash(node)}
+	}
+	combinedHash := combineSiblingHashes(entries, bucketKey)
+
+	if !bytes.Equal(directHash, combinedHash) {
+		t.Fatalf("expected combining precomputed per-node hashes [%x] to match feeding the real nodes directly into one calculator [%x]", combinedHash, directHash)
+	}
+}